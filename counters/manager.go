@@ -4,22 +4,65 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/seiflotfy/skizze/config"
 	"github.com/seiflotfy/skizze/counters/abstract"
+	"github.com/seiflotfy/skizze/counters/wrappers/bloom"
 	"github.com/seiflotfy/skizze/counters/wrappers/count-min-log"
 	"github.com/seiflotfy/skizze/counters/wrappers/hllpp"
 	"github.com/seiflotfy/skizze/counters/wrappers/topk"
+	"github.com/seiflotfy/skizze/counters/wrappers/windowed"
 	"github.com/seiflotfy/skizze/storage"
 	"github.com/seiflotfy/skizze/utils"
 )
 
+// numShards is the number of shards the sketch table is split across. Picking
+// a sketch's shard by hashing its ID spreads lock contention across
+// independent goroutines touching unrelated sketches, while the per-sketch
+// lock inside each entry still serializes concurrent operations against the
+// same sketch.
+const numShards = 32
+
+/*
+sketchEntry bundles a counter with the lock that must be held for the
+duration of any operation against it, so that e.g. AddToSketch can never run
+concurrently with a DeleteSketch of the same ID.
+*/
+type sketchEntry struct {
+	mu      sync.RWMutex
+	counter abstract.Counter
+	info    *abstract.Info
+}
+
+/*
+shard owns a slice of the sketch table, guarded by its own RWMutex. Structural
+changes (adding/removing a sketch) take the shard's write lock; everything
+else works against the per-sketch lock on the entry.
+*/
+type shard struct {
+	mu      sync.RWMutex
+	entries map[string]*sketchEntry
+}
+
+func newShard() *shard {
+	return &shard{entries: make(map[string]*sketchEntry)}
+}
+
+func shardFor(shards [numShards]*shard, id string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return shards[h.Sum32()%numShards]
+}
+
 /*
 ManagerStruct is responsible for manipulating the counters and syncing to disk
 */
 type ManagerStruct struct {
-	sketches map[string]abstract.Counter
-	info     map[string]*abstract.Info
+	shards [numShards]*shard
 }
 
 var manager *ManagerStruct
@@ -30,10 +73,14 @@ CreateSketch ...
 */
 func (m *ManagerStruct) CreateSketch(sketchID string, sketchType string, props map[string]float64) error {
 	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
+	s := shardFor(m.shards, id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	// Check if sketch with ID already exists
-	if info, ok := m.info[id]; ok {
-		errStr := fmt.Sprintf("Sketch %s of type %s already exists", id, info.Type)
+	if entry, ok := s.entries[id]; ok {
+		errStr := fmt.Sprintf("Sketch %s of type %s already exists", id, entry.info.Type)
 		return errors.New(errStr)
 	}
 
@@ -51,37 +98,51 @@ func (m *ManagerStruct) CreateSketch(sketchID string, sketchType string, props m
 		State:      make(map[string]uint64)}
 	var sketch abstract.Counter
 	var err error
-	switch sketchType {
-	case abstract.HLLPP:
-		sketch, err = hllpp.NewSketch(info)
-	case abstract.TopK:
-		sketch, err = topk.NewSketch(info)
-	case abstract.CML:
-		sketch, err = cml.NewSketch(info)
-	default:
-		return errors.New("Invalid sketch type: " + sketchType)
+	if _, ok := props["window"]; ok {
+		sketch, err = windowed.NewSketch(info, func() (abstract.Counter, error) {
+			return newSketch(sketchType, info)
+		})
+	} else {
+		sketch, err = newSketch(sketchType, info)
 	}
-
 	if err != nil {
 		errTxt := fmt.Sprint("Could not load sketch ", info, ". Err:", err)
 		return errors.New(errTxt)
 	}
-	m.sketches[info.ID] = sketch
+	s.entries[id] = &sketchEntry{counter: sketch, info: info}
 	m.dumpInfo(info)
 	return nil
 }
 
 /*
 DeleteSketch ...
+
+Removes the entry from the shard map before touching its on-disk state, but
+only holds the shard lock for that brief map removal, not for the rest of
+the call: AddToSketch/GetCountForSketch/etc. resolve their entry under a
+brief shard RLock and then only hold entry.mu for the rest of the
+operation, so holding the shard lock any longer here would stall every
+other sketch in the same shard for as long as some unrelated in-flight
+operation on this one takes. Taking entry.mu afterwards still serializes
+with any such operation that already holds it before the on-disk data is
+deleted out from under it.
 */
 func (m *ManagerStruct) DeleteSketch(sketchID string, sketchType string) error {
 	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
+	s := shardFor(m.shards, id)
 
-	if _, ok := m.sketches[id]; !ok {
+	s.mu.Lock()
+	entry, ok := s.entries[id]
+	if !ok {
+		s.mu.Unlock()
 		return errors.New("No such sketch " + sketchID)
 	}
-	delete(m.sketches, id)
-	delete(m.info, id)
+	delete(s.entries, id)
+	s.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
 	manager := storage.GetManager()
 	err := manager.DeleteInfo(id)
 	if err != nil {
@@ -95,55 +156,221 @@ GetSketches ...
 */
 func (m *ManagerStruct) GetSketches() ([]string, error) {
 	// TODO: Remove dummy data and implement proper result
-	sketches := make([]string, len(m.sketches), len(m.sketches))
-	i := 0
-	for _, v := range m.sketches {
-		typ := v.GetType()
-		id := v.GetID()
-		sketches[i] = fmt.Sprintf("%s/%s", typ, id[:len(id)-len(typ)-1])
-		i++
+	sketches := make([]string, 0)
+	for _, s := range m.shards {
+		s.mu.RLock()
+		for _, entry := range s.entries {
+			typ := entry.counter.GetType()
+			id := entry.counter.GetID()
+			sketches = append(sketches, fmt.Sprintf("%s/%s", typ, id[:len(id)-len(typ)-1]))
+		}
+		s.mu.RUnlock()
 	}
 	return sketches, nil
 }
 
+func (m *ManagerStruct) getEntry(id string) (*sketchEntry, bool) {
+	s := shardFor(m.shards, id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.entries[id]
+	return entry, ok
+}
+
 /*
 AddToSketch ...
 */
 func (m *ManagerStruct) AddToSketch(sketchID string, sketchType string, values []string) error {
 	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
 
-	var val, ok = m.sketches[id]
-	if ok == false {
+	entry, ok := m.getEntry(id)
+	if !ok {
 		errStr := fmt.Sprintf("No such sketch %s of type %s found", sketchID, sketchType)
 		return errors.New(errStr)
 	}
-	var counter abstract.Counter
-	counter = val.(abstract.Counter)
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
 
 	bytes := make([][]byte, len(values), len(values))
 	for i, value := range values {
 		bytes[i] = []byte(value)
 	}
-	counter.AddMultiple(bytes)
+	entry.counter.AddMultiple(bytes)
 	return nil
 }
 
+/*
+MergeSketches folds the state of srcIDs into destID in place, so that destID
+ends up answering queries over the union of everything ever added to any of
+the sources. All sketches involved must share sketchType.
+
+Locks are acquired in sorted key order rather than dest-then-sources: two
+concurrent merges with their dest/src roles swapped (A into B, and B into A)
+would otherwise each hold their own write lock while waiting on the other's,
+deadlocking. Acquiring every lock in the same global order regardless of role
+rules that out.
+*/
+func (m *ManagerStruct) MergeSketches(destID string, srcIDs []string, sketchType string) error {
+	destKey := fmt.Sprintf("%s.%s", destID, sketchType)
+
+	seen := map[string]bool{destKey: true}
+	keys := make([]string, 0, len(srcIDs)+1)
+	keys = append(keys, destKey)
+	for _, srcID := range srcIDs {
+		srcKey := fmt.Sprintf("%s.%s", srcID, sketchType)
+		if seen[srcKey] {
+			continue
+		}
+		seen[srcKey] = true
+		keys = append(keys, srcKey)
+	}
+	sort.Strings(keys)
+
+	entries := make(map[string]*sketchEntry, len(keys))
+	for _, key := range keys {
+		entry, ok := m.getEntry(key)
+		if !ok {
+			return fmt.Errorf("No such sketch %s of type %s found", strings.TrimSuffix(key, "."+sketchType), sketchType)
+		}
+		entries[key] = entry
+	}
+
+	for _, key := range keys {
+		if key == destKey {
+			entries[key].mu.Lock()
+			defer entries[key].mu.Unlock()
+		} else {
+			entries[key].mu.RLock()
+			defer entries[key].mu.RUnlock()
+		}
+	}
+
+	dest := entries[destKey]
+	// Walk the deduped keys, not the raw srcIDs: merging the same source twice
+	// would double-count it for sketch types whose Merge isn't idempotent
+	// (e.g. the CML wrapper's cell-wise add).
+	for _, key := range keys {
+		if key == destKey {
+			continue
+		}
+		if err := dest.counter.Merge(entries[key].counter); err != nil {
+			return fmt.Errorf("Could not merge %s into %s: %s", strings.TrimSuffix(key, "."+sketchType), destID, err)
+		}
+	}
+	return nil
+}
+
+/*
+Op is a single operation queued against the manager by a /batch request: add
+values to, or remove values from, one sketch.
+*/
+type Op struct {
+	Op         string   `json:"op"`
+	Sketch     string   `json:"sketch"`
+	SketchType string   `json:"sketchType"`
+	Values     []string `json:"values"`
+}
+
+/*
+Result is the outcome of one Op, reported back in the same order as the ops
+were given. Error is a plain string, not the error interface: encoding/json
+can't see into an *errors.errorString's unexported field, so storing the
+interface directly would serialize every failure as "{}" over the wire.
+*/
+type Result struct {
+	Error string `json:"error"`
+}
+
+/*
+Batch runs every op in ops against the manager, grouping ops by sketch so
+that AddMultiple/RemoveMultiple is called once per *run* of same-typed ops
+against the same sketch rather than once per op. This turns what would
+otherwise be len(ops) lock acquisitions and hash passes into far fewer for a
+bulk load, while still applying adds and removes in the order they were
+given — a "remove x, add x" batch must leave x present, not the reverse.
+*/
+func (m *ManagerStruct) Batch(ops []Op) []Result {
+	results := make([]Result, len(ops))
+
+	// runIdx groups the indexes of each maximal run of consecutive,
+	// same-op, same-sketch entries so they can be applied with a single
+	// AddMultiple/RemoveMultiple call without reordering across runs.
+	i := 0
+	for i < len(ops) {
+		op := ops[i]
+		if op.Op != "add" && op.Op != "remove" {
+			results[i].Error = "Unknown batch op: " + op.Op
+			i++
+			continue
+		}
+		key := fmt.Sprintf("%s.%s", op.Sketch, op.SketchType)
+
+		j := i + 1
+		for j < len(ops) && ops[j].Op == op.Op &&
+			fmt.Sprintf("%s.%s", ops[j].Sketch, ops[j].SketchType) == key {
+			j++
+		}
+		runIdx := make([]int, 0, j-i)
+		values := make([]string, 0, j-i)
+		for k := i; k < j; k++ {
+			runIdx = append(runIdx, k)
+			values = append(values, ops[k].Values...)
+		}
+
+		entry, ok := m.getEntry(key)
+		if !ok {
+			errText := "No such sketch: " + key
+			for _, k := range runIdx {
+				results[k].Error = errText
+			}
+			i = j
+			continue
+		}
+
+		bytes := make([][]byte, len(values))
+		for v, value := range values {
+			bytes[v] = []byte(value)
+		}
+
+		var err error
+		entry.mu.Lock()
+		if op.Op == "add" {
+			_, err = entry.counter.AddMultiple(bytes)
+		} else {
+			_, err = entry.counter.RemoveMultiple(bytes)
+		}
+		entry.mu.Unlock()
+
+		if err != nil {
+			for _, k := range runIdx {
+				results[k].Error = err.Error()
+			}
+		}
+		i = j
+	}
+
+	return results
+}
+
 /*
 DeleteFromSketch ...
 */
 func (m *ManagerStruct) DeleteFromSketch(sketchID string, sketchType string, values []string) error {
-	var val, ok = m.sketches[sketchID]
-	if ok == false {
+	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
+	entry, ok := m.getEntry(id)
+	if !ok {
 		return errors.New("No such sketch: " + sketchID)
 	}
-	var counter abstract.Counter
-	counter = val.(abstract.Counter)
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
 
 	bytes := make([][]byte, len(values), len(values))
 	for i, value := range values {
 		bytes[i] = []byte(value)
 	}
-	ok, err := counter.RemoveMultiple(bytes)
+	_, err := entry.counter.RemoveMultiple(bytes)
 	return err
 }
 
@@ -152,14 +379,16 @@ GetCountForSketch ...
 */
 func (m *ManagerStruct) GetCountForSketch(sketchID string, sketchType string, values []string) (interface{}, error) {
 	id := fmt.Sprintf("%s.%s", sketchID, sketchType)
-	var val, ok = m.sketches[id]
-	if ok == false {
+	entry, ok := m.getEntry(id)
+	if !ok {
 		errStr := fmt.Sprintf("No such sketch %s of type %s found", sketchID, sketchType)
 		return 0, errors.New(errStr)
 	}
-	var counter abstract.Counter
-	counter = val.(abstract.Counter)
 
+	entry.mu.RLock()
+	defer entry.mu.RUnlock()
+
+	counter := entry.counter
 	if counter.GetType() == abstract.CML {
 		bvalues := make([][]byte, len(values), len(values))
 		for i, value := range values {
@@ -189,8 +418,10 @@ func GetManager() (*ManagerStruct, error) {
 }
 
 func newManager() (*ManagerStruct, error) {
-	sketches := make(map[string]abstract.Counter)
-	m := &ManagerStruct{sketches, make(map[string]*abstract.Info)}
+	m := &ManagerStruct{}
+	for i := range m.shards {
+		m.shards[i] = newShard()
+	}
 	err := m.loadInfo()
 	if err != nil {
 		return nil, err
@@ -203,7 +434,6 @@ func newManager() (*ManagerStruct, error) {
 }
 
 func (m *ManagerStruct) dumpInfo(i *abstract.Info) {
-	m.info[i.ID] = i
 	manager := storage.GetManager()
 	infoData, err := json.Marshal(i)
 	utils.PanicOnError(err)
@@ -212,43 +442,80 @@ func (m *ManagerStruct) dumpInfo(i *abstract.Info) {
 
 func (m *ManagerStruct) loadInfo() error {
 	manager := storage.GetManager()
-	var infoStruct abstract.Info
 	infos, err := manager.LoadAllInfo()
 	if err != nil {
 		return err
 	}
 	for _, infoData := range infos {
+		var infoStruct abstract.Info
 		json.Unmarshal(infoData, &infoStruct)
-		m.info[infoStruct.ID] = &infoStruct
+		s := shardFor(m.shards, infoStruct.ID)
+		info := infoStruct
+		s.entries[info.ID] = &sketchEntry{info: &info}
 	}
 	return nil
 }
 
 func (m *ManagerStruct) loadSketches() error {
 	strg := storage.GetManager()
-	for key, info := range m.info {
-		var sketch abstract.Counter
-		var err error
-		switch info.Type {
-		case abstract.HLLPP:
-			sketch, err = hllpp.NewSketchFromData(info)
-		case abstract.TopK:
-			sketch, err = topk.NewSketchFromData(info)
-		case abstract.CML:
-			sketch, err = cml.NewSketchFromData(info)
-		default:
-			logger.Info.Println("Invalid counter type", info.Type)
+	for _, s := range m.shards {
+		for key, entry := range s.entries {
+			info := entry.info
+			var sketch abstract.Counter
+			var err error
+			if _, ok := info.Properties["window"]; ok {
+				sketch, err = windowed.NewSketchFromData(info, func() (abstract.Counter, error) {
+					return newSketch(info.Type, info)
+				})
+			} else {
+				sketch, err = newSketchFromData(info.Type, info)
+			}
+			if err != nil {
+				errTxt := fmt.Sprint("Could not load sketch ", info, ". Err: ", err)
+				return errors.New(errTxt)
+			}
+			entry.counter = sketch
+			strg.LoadData(key, 0, 0)
 		}
-		if err != nil {
-			errTxt := fmt.Sprint("Could not load sketch ", info, ". Err: ", err)
-			return errors.New(errTxt)
-		}
-		m.sketches[info.ID] = sketch
-		strg.LoadData(key, 0, 0)
 	}
 	return nil
 }
 
+// newSketch constructs a fresh, empty counter of sketchType. It's shared by
+// CreateSketch and loadSketches, and also handed to windowed.NewSketch as
+// the factory that builds each bucket in the ring.
+func newSketch(sketchType string, info *abstract.Info) (abstract.Counter, error) {
+	switch sketchType {
+	case abstract.HLLPP:
+		return hllpp.NewSketch(info)
+	case abstract.TopK:
+		return topk.NewSketch(info)
+	case abstract.CML:
+		return cml.NewSketch(info)
+	case abstract.Bloom:
+		return bloom.NewSketch(info)
+	default:
+		return nil, errors.New("Invalid sketch type: " + sketchType)
+	}
+}
+
+// newSketchFromData is newSketch's counterpart for restoring a counter whose
+// data has already been loaded from storage.Manager.
+func newSketchFromData(sketchType string, info *abstract.Info) (abstract.Counter, error) {
+	switch sketchType {
+	case abstract.HLLPP:
+		return hllpp.NewSketchFromData(info)
+	case abstract.TopK:
+		return topk.NewSketchFromData(info)
+	case abstract.CML:
+		return cml.NewSketchFromData(info)
+	case abstract.Bloom:
+		return bloom.NewSketchFromData(info)
+	default:
+		return nil, errors.New("Invalid counter type: " + sketchType)
+	}
+}
+
 /*
 Destroy ...
 */
@@ -0,0 +1,101 @@
+package counters
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/seiflotfy/skizze/counters/abstract"
+)
+
+// TestConcurrentOpsAcrossShardsDontRace exercises many goroutines hammering
+// AddToSketch/GetCountForSketch/DeleteFromSketch against many distinct
+// sketches at once, so that any two IDs landing in the same shard still
+// serialize correctly while IDs in different shards proceed independently.
+// Run with -race to catch data races on the shard/entry locking itself.
+func TestConcurrentOpsAcrossShardsDontRace(t *testing.T) {
+	const numSketches = numShards * 3
+	counters := make([]*testCounter, numSketches)
+	for i := range counters {
+		info := &abstract.Info{ID: fmt.Sprintf("sketch%d.t", i), Type: "t"}
+		counters[i] = newTestCounter(info)
+	}
+	m := newTestManager(counters...)
+
+	done := make(chan error, numSketches)
+	for i := 0; i < numSketches; i++ {
+		sketchID := fmt.Sprintf("sketch%d", i)
+		go func(sketchID string) {
+			if err := m.AddToSketch(sketchID, "t", []string{"v1", "v2"}); err != nil {
+				done <- err
+				return
+			}
+			if _, err := m.GetCountForSketch(sketchID, "t", nil); err != nil {
+				done <- err
+				return
+			}
+			done <- m.DeleteFromSketch(sketchID, "t", []string{"v1"})
+		}(sketchID)
+	}
+
+	for i := 0; i < numSketches; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("concurrent ops across shards deadlocked")
+		}
+	}
+
+	for i, c := range counters {
+		if !c.set["v2"] {
+			t.Fatalf("sketch%d: expected \"v2\" to remain after delete of \"v1\"", i)
+		}
+		if c.set["v1"] {
+			t.Fatalf("sketch%d: expected \"v1\" to be deleted", i)
+		}
+	}
+}
+
+// TestDeleteSketchWaitsForInFlightOperation simulates an AddToSketch that's
+// already past getEntry and holding entry.mu when DeleteSketch starts:
+// DeleteSketch drops the entry from the shard map at once, but must then block
+// on that same entry lock rather than deleting the sketch's stored state out
+// from under the in-flight operation.
+func TestDeleteSketchWaitsForInFlightOperation(t *testing.T) {
+	info := &abstract.Info{ID: "x.t", Type: "t"}
+	c := newTestCounter(info)
+	m := newTestManager(c)
+
+	entry, ok := m.getEntry(info.ID)
+	if !ok {
+		t.Fatal("expected entry to exist")
+	}
+	entry.mu.Lock() // stand in for an in-flight AddToSketch
+
+	deleteDone := make(chan error, 1)
+	go func() { deleteDone <- m.DeleteSketch("x", "t") }()
+
+	select {
+	case <-deleteDone:
+		t.Fatal("DeleteSketch returned before the in-flight operation released its lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	entry.mu.Unlock() // the "in-flight" op finishes
+
+	select {
+	case err := <-deleteDone:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("DeleteSketch did not complete after the lock was released")
+	}
+
+	if _, ok := m.getEntry(info.ID); ok {
+		t.Fatal("expected sketch to be removed after DeleteSketch")
+	}
+}
@@ -0,0 +1,200 @@
+package counters
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/seiflotfy/skizze/counters/abstract"
+	"github.com/seiflotfy/skizze/counters/wrappers/windowed"
+	"github.com/seiflotfy/skizze/storage"
+)
+
+// snapshotVersion guards the archive format: bump it whenever the framing
+// below changes shape, so Restore can reject an archive it can't parse
+// instead of silently misreading it.
+const snapshotVersion uint32 = 1
+
+/*
+Snapshot streams a self-describing archive of every sketch to w: a version,
+then for each sketch a length-prefixed abstract.Info JSON blob followed by
+the length-prefixed raw bytes produced by that sketch's own Marshal. This is
+independent of the on-disk storage.Manager layout, so it doubles as a
+portable backup format and as the payload for warm-standby replication.
+*/
+func (m *ManagerStruct) Snapshot(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, snapshotVersion); err != nil {
+		return err
+	}
+
+	for _, shard := range m.shards {
+		shard.mu.RLock()
+		err := func() error {
+			defer shard.mu.RUnlock()
+			for _, entry := range shard.entries {
+				entry.mu.RLock()
+				err := writeSnapshotEntry(w, entry)
+				entry.mu.RUnlock()
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSnapshotEntry(w io.Writer, entry *sketchEntry) error {
+	// Marshal first: a windowed sketch records its current bucket deadlines
+	// into entry.info.State while marshaling, and the archived Info must carry
+	// those rather than whatever was recorded before.
+	stateData, err := entry.counter.Marshal()
+	if err != nil {
+		return err
+	}
+	infoData, err := json.Marshal(entry.info)
+	if err != nil {
+		return err
+	}
+
+	if err := writeChunk(w, infoData); err != nil {
+		return err
+	}
+	return writeChunk(w, stateData)
+}
+
+func writeChunk(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readChunk(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+/*
+Restore reads an archive produced by Snapshot and rebuilds the in-memory
+sketch table from it, replacing whatever sketches are currently loaded. Each
+sketch is recreated from its archived Info (via windowed.NewSketchFromData for
+a windowed sketch, so it gets its buckets back, and newSketchFromData
+otherwise) and then has its raw state restored via Unmarshal.
+
+r is read into memory in full before any shard lock is taken: r is typically
+an HTTP request body, and parsing directly off of it while holding every
+shard's lock would let a slow or misbehaving client stall every other
+operation on the manager for as long as it trickles bytes. Every shard's
+write lock is then held for the rest of the call - parsing the buffered
+archive, rebuilding each sketch, and the final cleanup-and-swap - so that a
+CreateSketch/DeleteSketch racing a Restore can't be silently undone by the
+swap the way it could if the locks were only taken for the swap itself.
+*/
+func (m *ManagerStruct) Restore(r io.Reader) error {
+	var version uint32
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return err
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("Unsupported snapshot version: %d", version)
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	br := bytes.NewReader(body)
+
+	for i := range m.shards {
+		m.shards[i].mu.Lock()
+	}
+	defer func() {
+		for i := range m.shards {
+			m.shards[i].mu.Unlock()
+		}
+	}()
+
+	restored := [numShards]*shard{}
+	for i := range restored {
+		restored[i] = newShard()
+	}
+	restoredIDs := make(map[string]bool)
+
+	for {
+		infoData, err := readChunk(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		stateData, err := readChunk(br)
+		if err != nil {
+			return err
+		}
+
+		var info abstract.Info
+		if err := json.Unmarshal(infoData, &info); err != nil {
+			return err
+		}
+
+		var sketch abstract.Counter
+		if _, ok := info.Properties["window"]; ok {
+			sketch, err = windowed.NewSketchFromData(&info, func() (abstract.Counter, error) {
+				return newSketch(info.Type, &info)
+			})
+		} else {
+			// newSketchFromData, not newSketch: the latter is the fresh/empty
+			// constructor and for types like Bloom re-initializes State
+			// fields (e.g. resets "count" to 0), clobbering the values that
+			// came with the archived Info.
+			sketch, err = newSketchFromData(info.Type, &info)
+		}
+		if err == nil {
+			err = sketch.Unmarshal(stateData)
+		}
+		if err != nil {
+			return errors.New("Could not restore sketch " + info.ID + ": " + err.Error())
+		}
+
+		s := shardFor(restored, info.ID)
+		s.entries[info.ID] = &sketchEntry{counter: sketch, info: &info}
+		restoredIDs[info.ID] = true
+		m.dumpInfo(&info)
+	}
+
+	// Any sketch that existed before this restore but isn't in the archive
+	// must be dropped from disk too, or a later restart would resurrect it
+	// from its still-present Info file.
+	strg := storage.GetManager()
+	for _, s := range m.shards {
+		for id := range s.entries {
+			if !restoredIDs[id] {
+				strg.DeleteInfo(id)
+				strg.DeleteData(id)
+			}
+		}
+	}
+
+	for i := range m.shards {
+		m.shards[i].entries = restored[i].entries
+	}
+	return nil
+}
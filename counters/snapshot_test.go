@@ -0,0 +1,174 @@
+package counters
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/seiflotfy/skizze/counters/abstract"
+)
+
+func TestSnapshotRestoreRoundTrip(t *testing.T) {
+	info := &abstract.Info{
+		ID:         "marvel." + abstract.Bloom,
+		Type:       abstract.Bloom,
+		Properties: map[string]float64{"capacity": 1000, "errorRate": 0.01},
+		State:      make(map[string]uint64),
+	}
+	sketch, err := newSketch(abstract.Bloom, info)
+	if err != nil {
+		t.Fatalf("could not create sketch: %s", err)
+	}
+	sketch.AddMultiple([][]byte{[]byte("magneto"), []byte("wasp")})
+
+	m := newTestManager()
+	s := shardFor(m.shards, info.ID)
+	s.entries[info.ID] = &sketchEntry{counter: sketch, info: info}
+
+	var buf bytes.Buffer
+	if err := m.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %s", err)
+	}
+
+	restored := newTestManager()
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+
+	entry, ok := restored.getEntry(info.ID)
+	if !ok {
+		t.Fatalf("expected %s to be restored", info.ID)
+	}
+	if got := entry.counter.GetCount(); got != 2 {
+		t.Fatalf("expected restored count 2, got %d", got)
+	}
+
+	freq, ok := entry.counter.GetFrequency([][]byte{[]byte("magneto"), []byte("unknown-hero")}).(map[string]uint)
+	if !ok {
+		t.Fatal("expected GetFrequency to return a map[string]uint")
+	}
+	if freq["magneto"] != 1 {
+		t.Fatal("expected \"magneto\" present after restore")
+	}
+	if freq["unknown-hero"] != 0 {
+		t.Fatal("expected \"unknown-hero\" absent after restore")
+	}
+}
+
+func TestRestoreDropsSketchesMissingFromArchive(t *testing.T) {
+	stale := &abstract.Info{ID: "stale.t", Type: "t"}
+	m := newTestManager(newTestCounter(stale))
+
+	var buf bytes.Buffer
+	empty := newTestManager()
+	if err := empty.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %s", err)
+	}
+
+	if err := m.Restore(&buf); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+	if _, ok := m.getEntry(stale.ID); ok {
+		t.Fatal("expected sketch missing from the archive to be dropped by Restore")
+	}
+}
+
+// TestRestoreDoesNotBlockOtherOpsWhileReadingArchive feeds Restore a reader
+// that stalls mid-archive, standing in for a slow HTTP request body. A
+// concurrent CreateSketch must not be blocked by that stall: Restore only
+// takes its shard locks after the archive is fully buffered, so a slow or
+// misbehaving client on POST /restore can't hold up every other operation.
+func TestRestoreDoesNotBlockOtherOpsWhileReadingArchive(t *testing.T) {
+	pr, pw := io.Pipe()
+	release := make(chan struct{})
+	go func() {
+		binary.Write(pw, binary.BigEndian, snapshotVersion)
+		<-release
+		pw.Close() // empty archive body: Restore sees EOF and finishes cleanly
+	}()
+
+	m := newTestManager()
+	restoreDone := make(chan error, 1)
+	go func() { restoreDone <- m.Restore(pr) }()
+
+	createDone := make(chan error, 1)
+	go func() { createDone <- m.CreateSketch("x", "t", nil) }()
+
+	select {
+	case <-createDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("CreateSketch was blocked by an in-progress Restore still reading its archive")
+	}
+
+	close(release)
+	select {
+	case err := <-restoreDone:
+		if err != nil {
+			t.Fatalf("Restore failed: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Restore did not finish after being unblocked")
+	}
+}
+
+// TestRestoreSwapIsAtomicWithConcurrentOp seeds a manager, takes a snapshot
+// of it, then concurrently restores that snapshot while issuing many
+// DeleteFromSketch calls against the seeded sketch. Restore holds every
+// shard's write lock across its cleanup-and-swap, so those concurrent calls
+// must each cleanly see either the pre-restore or the post-restore table,
+// not a torn intermediate state, and neither side should deadlock.
+func TestRestoreSwapIsAtomicWithConcurrentOp(t *testing.T) {
+	// Restore can only rebuild registered sketch types, so seed a real Bloom
+	// filter rather than a testCounter.
+	seed := &abstract.Info{
+		ID:         "seed." + abstract.Bloom,
+		Type:       abstract.Bloom,
+		Properties: map[string]float64{"capacity": 1000, "errorRate": 0.01},
+		State:      make(map[string]uint64),
+	}
+	sketch, err := newSketch(abstract.Bloom, seed)
+	if err != nil {
+		t.Fatalf("could not create sketch: %s", err)
+	}
+	m := newTestManager()
+	shardFor(m.shards, seed.ID).entries[seed.ID] = &sketchEntry{counter: sketch, info: seed}
+
+	var buf bytes.Buffer
+	if err := m.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot failed: %s", err)
+	}
+
+	restoreDone := make(chan error, 1)
+	go func() { restoreDone <- m.Restore(&buf) }()
+
+	done := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			done <- m.DeleteFromSketch("seed", abstract.Bloom, nil)
+			_ = i
+		}(i)
+	}
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("concurrent op alongside Restore deadlocked")
+		}
+	}
+
+	select {
+	case err := <-restoreDone:
+		if err != nil {
+			t.Fatalf("Restore failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Restore did not finish")
+	}
+
+	if _, ok := m.getEntry(seed.ID); !ok {
+		t.Fatal("expected restored sketch to be present after the swap")
+	}
+}
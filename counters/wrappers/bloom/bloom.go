@@ -0,0 +1,249 @@
+package bloom
+
+import (
+	"errors"
+	"math"
+
+	"github.com/seiflotfy/skizze/counters/abstract"
+	"github.com/spaolacci/murmur3"
+)
+
+/*
+Sketch is a classic Bloom filter: a bit array sized from the requested
+capacity/errorRate, with k double-hashed probes per key. It answers "have I
+seen this before" with no false negatives and a bounded false positive rate,
+but unlike HLL++ or CML it cannot be shrunk back down (Remove is unsupported)
+and it has no notion of per-item frequency.
+*/
+type Sketch struct {
+	info *abstract.Info
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+/*
+NewSketch creates a new Bloom filter sized from info.Properties["capacity"]
+and info.Properties["errorRate"], using the standard optimal sizing formulas
+m = ceil(-n*ln(p) / ln(2)^2) bits and k = round((m/n)*ln(2)) hash functions.
+*/
+func NewSketch(info *abstract.Info) (abstract.Counter, error) {
+	n := info.Properties["capacity"]
+	p := info.Properties["errorRate"]
+	if n <= 0 {
+		return nil, errors.New("Bloom filter requires a positive capacity")
+	}
+	if p <= 0 || p >= 1 {
+		return nil, errors.New("Bloom filter requires an errorRate in (0, 1)")
+	}
+
+	m := uint64(math.Ceil(-n * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round((float64(m) / n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+
+	info.State["m"] = m
+	info.State["k"] = k
+	info.State["count"] = 0
+
+	return &Sketch{
+		info: info,
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}, nil
+}
+
+/*
+NewSketchFromData recreates a Bloom filter from previously persisted Info,
+restoring the sizing that was computed when it was first created.
+*/
+func NewSketchFromData(info *abstract.Info) (abstract.Counter, error) {
+	m := info.State["m"]
+	k := info.State["k"]
+	if m == 0 || k == 0 {
+		return nil, errors.New("Invalid persisted Bloom filter state")
+	}
+	return &Sketch{
+		info: info,
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}, nil
+}
+
+// indexes computes the k bit positions probed for value, via double hashing
+// over the two 64-bit halves of a single MurmurHash3-128 digest.
+func (s *Sketch) indexes(value []byte) []uint64 {
+	h1, h2 := murmur3.Sum128(value)
+	idxs := make([]uint64, s.k)
+	for i := uint64(0); i < s.k; i++ {
+		idxs[i] = (h1 + i*h2) % s.m
+	}
+	return idxs
+}
+
+/*
+Add sets the bits for value's k hash probes, returning true if the value was
+not already (probably) present.
+*/
+func (s *Sketch) Add(value []byte) (bool, error) {
+	wasNew := false
+	for _, idx := range s.indexes(value) {
+		word, bit := idx/64, idx%64
+		if s.bits[word]&(1<<bit) == 0 {
+			wasNew = true
+		}
+		s.bits[word] |= 1 << bit
+	}
+	if wasNew {
+		s.info.State["count"]++
+	}
+	return wasNew, nil
+}
+
+/*
+AddMultiple adds every value in values.
+*/
+func (s *Sketch) AddMultiple(values [][]byte) (bool, error) {
+	for _, value := range values {
+		if _, err := s.Add(value); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+/*
+Remove is unsupported: a Bloom filter cannot unset bits without risking false
+negatives for unrelated keys that hash to the same positions.
+*/
+func (s *Sketch) Remove(value []byte) (bool, error) {
+	return false, errors.New("Remove is not supported for Bloom filters")
+}
+
+/*
+RemoveMultiple is unsupported, see Remove.
+*/
+func (s *Sketch) RemoveMultiple(values [][]byte) (bool, error) {
+	return false, errors.New("Remove is not supported for Bloom filters")
+}
+
+/*
+GetFrequency returns 1 per key if it is (probably) present, 0 otherwise.
+values is expected to contain exactly the keys being tested.
+*/
+func (s *Sketch) GetFrequency(values [][]byte) interface{} {
+	result := make(map[string]uint, len(values))
+	for _, value := range values {
+		present := true
+		for _, idx := range s.indexes(value) {
+			word, bit := idx/64, idx%64
+			if s.bits[word]&(1<<bit) == 0 {
+				present = false
+				break
+			}
+		}
+		if present {
+			result[string(value)] = 1
+		} else {
+			result[string(value)] = 0
+		}
+	}
+	return result
+}
+
+/*
+GetCount estimates the number of distinct items inserted so far from the
+fraction of bits set, via the standard -m*ln(1-X/m)/k estimator, where X is
+the number of bits currently set.
+*/
+func (s *Sketch) GetCount() uint64 {
+	set := uint64(0)
+	for _, word := range s.bits {
+		set += uint64(popcount(word))
+	}
+	if set == 0 {
+		return 0
+	}
+	if set >= s.m {
+		// Saturated: every bit is set, the estimator's log term blows up.
+		set = s.m - 1
+	}
+	x := float64(set)
+	m := float64(s.m)
+	k := float64(s.k)
+	return uint64(math.Round(-m * math.Log(1-x/m) / k))
+}
+
+func popcount(x uint64) int {
+	count := 0
+	for x != 0 {
+		count++
+		x &= x - 1
+	}
+	return count
+}
+
+/*
+GetType returns the sketch type as registered with the manager.
+*/
+func (s *Sketch) GetType() string {
+	return s.info.Type
+}
+
+/*
+GetID returns the sketch's fully-qualified ID.
+*/
+func (s *Sketch) GetID() string {
+	return s.info.ID
+}
+
+/*
+Merge ORs other's bit array into s, which is exactly set union for a Bloom
+filter. Both filters must have been sized identically (same m and k).
+*/
+func (s *Sketch) Merge(other abstract.Counter) error {
+	o, ok := other.(*Sketch)
+	if !ok {
+		return errors.New("Cannot merge non-Bloom sketch into Bloom filter")
+	}
+	if o.m != s.m || o.k != s.k {
+		return errors.New("Cannot merge Bloom filters of different sizes")
+	}
+	for i := range s.bits {
+		s.bits[i] |= o.bits[i]
+	}
+	return nil
+}
+
+/*
+Marshal serializes the bit array for persistence via storage.Manager.
+*/
+func (s *Sketch) Marshal() ([]byte, error) {
+	data := make([]byte, len(s.bits)*8)
+	for i, word := range s.bits {
+		for b := 0; b < 8; b++ {
+			data[i*8+b] = byte(word >> uint(b*8))
+		}
+	}
+	return data, nil
+}
+
+/*
+Unmarshal restores the bit array previously produced by Marshal.
+*/
+func (s *Sketch) Unmarshal(data []byte) error {
+	if len(data) != len(s.bits)*8 {
+		return errors.New("Invalid Bloom filter data length")
+	}
+	for i := range s.bits {
+		var word uint64
+		for b := 0; b < 8; b++ {
+			word |= uint64(data[i*8+b]) << uint(b*8)
+		}
+		s.bits[i] = word
+	}
+	return nil
+}
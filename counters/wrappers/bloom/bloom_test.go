@@ -0,0 +1,116 @@
+package bloom
+
+import (
+	"testing"
+
+	"github.com/seiflotfy/skizze/counters/abstract"
+)
+
+func newTestInfo() *abstract.Info {
+	return &abstract.Info{
+		ID:         "marvel." + abstract.Bloom,
+		Type:       abstract.Bloom,
+		Properties: map[string]float64{"capacity": 1000, "errorRate": 0.01},
+		State:      make(map[string]uint64),
+	}
+}
+
+func TestAddAndGetFrequency(t *testing.T) {
+	s, err := NewSketch(newTestInfo())
+	if err != nil {
+		t.Fatalf("could not create sketch: %s", err)
+	}
+
+	wasNew, err := s.Add([]byte("magneto"))
+	if err != nil {
+		t.Fatalf("Add failed: %s", err)
+	}
+	if !wasNew {
+		t.Fatal("expected first Add of \"magneto\" to report wasNew")
+	}
+
+	freq, ok := s.GetFrequency([][]byte{[]byte("magneto"), []byte("unknown-hero")}).(map[string]uint)
+	if !ok {
+		t.Fatal("expected GetFrequency to return a map[string]uint")
+	}
+	if freq["magneto"] != 1 {
+		t.Fatal("expected \"magneto\" to be present")
+	}
+	if freq["unknown-hero"] != 0 {
+		t.Fatal("expected \"unknown-hero\" to be absent")
+	}
+}
+
+func TestGetCountEstimatesCardinality(t *testing.T) {
+	s, err := NewSketch(newTestInfo())
+	if err != nil {
+		t.Fatalf("could not create sketch: %s", err)
+	}
+
+	s.AddMultiple([][]byte{[]byte("magneto"), []byte("wasp"), []byte("thor")})
+
+	if got := s.GetCount(); got != 3 {
+		t.Fatalf("expected estimated count 3, got %d", got)
+	}
+}
+
+func TestMergeIsUnion(t *testing.T) {
+	a, err := NewSketch(newTestInfo())
+	if err != nil {
+		t.Fatalf("could not create sketch a: %s", err)
+	}
+	b, err := NewSketch(newTestInfo())
+	if err != nil {
+		t.Fatalf("could not create sketch b: %s", err)
+	}
+
+	a.Add([]byte("magneto"))
+	b.Add([]byte("wasp"))
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge failed: %s", err)
+	}
+
+	freq, ok := a.GetFrequency([][]byte{[]byte("magneto"), []byte("wasp")}).(map[string]uint)
+	if !ok {
+		t.Fatal("expected GetFrequency to return a map[string]uint")
+	}
+	if freq["magneto"] != 1 || freq["wasp"] != 1 {
+		t.Fatal("expected merged sketch to contain both \"magneto\" and \"wasp\"")
+	}
+}
+
+func TestMarshalUnmarshalRoundTrip(t *testing.T) {
+	info := newTestInfo()
+	s, err := NewSketch(info)
+	if err != nil {
+		t.Fatalf("could not create sketch: %s", err)
+	}
+	s.AddMultiple([][]byte{[]byte("magneto"), []byte("wasp")})
+
+	data, err := s.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	// info.State["m"]/["k"] were populated by NewSketch above; NewSketchFromData
+	// needs that same persisted sizing to rebuild a same-shaped bit array.
+	restored, err := NewSketchFromData(info)
+	if err != nil {
+		t.Fatalf("NewSketchFromData failed: %s", err)
+	}
+	if err := restored.Unmarshal(data); err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	freq, ok := restored.GetFrequency([][]byte{[]byte("magneto"), []byte("wasp"), []byte("unknown-hero")}).(map[string]uint)
+	if !ok {
+		t.Fatal("expected GetFrequency to return a map[string]uint")
+	}
+	if freq["magneto"] != 1 || freq["wasp"] != 1 {
+		t.Fatal("expected restored sketch to contain both \"magneto\" and \"wasp\"")
+	}
+	if freq["unknown-hero"] != 0 {
+		t.Fatal("expected \"unknown-hero\" to be absent after restore")
+	}
+}
@@ -0,0 +1,21 @@
+package cml
+
+import (
+	"errors"
+
+	"github.com/seiflotfy/skizze/counters/abstract"
+)
+
+/*
+Merge adds other's cells into s's matrix, position for position. Both
+matrices must have been created with the same depth/width (i.e. the same
+capacity/errorRate), since a cell-wise add is only meaningful when the hash
+functions line up.
+*/
+func (s *Sketch) Merge(other abstract.Counter) error {
+	o, ok := other.(*Sketch)
+	if !ok {
+		return errors.New("Cannot merge non-CML sketch into CML sketch")
+	}
+	return s.cml.Merge(o.cml)
+}
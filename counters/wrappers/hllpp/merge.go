@@ -0,0 +1,20 @@
+package hllpp
+
+import (
+	"errors"
+
+	"github.com/seiflotfy/skizze/counters/abstract"
+)
+
+/*
+Merge folds other's registers into s by taking the element-wise max, which is
+exactly what a HyperLogLog union is. other must be another HLL++ sketch of
+the same precision; anything else is rejected rather than silently ignored.
+*/
+func (s *Sketch) Merge(other abstract.Counter) error {
+	o, ok := other.(*Sketch)
+	if !ok {
+		return errors.New("Cannot merge non-HLL++ sketch into HLL++ sketch")
+	}
+	return s.hll.Merge(o.hll)
+}
@@ -0,0 +1,24 @@
+package topk
+
+import (
+	"errors"
+
+	"github.com/seiflotfy/skizze/counters/abstract"
+)
+
+/*
+Merge combines other's tracked items into s by summing the frequencies of any
+items the two top-k sets have in common and re-heaping, so the result keeps
+the k globally heaviest items across both inputs rather than just s's own.
+*/
+func (s *Sketch) Merge(other abstract.Counter) error {
+	o, ok := other.(*Sketch)
+	if !ok {
+		return errors.New("Cannot merge non-TopK sketch into TopK sketch")
+	}
+
+	for _, elem := range o.topk.Elements() {
+		s.topk.Insert(elem.Value, elem.Count)
+	}
+	return nil
+}
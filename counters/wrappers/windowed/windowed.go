@@ -0,0 +1,321 @@
+package windowed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/seiflotfy/skizze/counters/abstract"
+)
+
+/*
+Factory builds a fresh, empty bucket of the underlying sketch type. The
+manager supplies one bound to whatever concrete type (HLL++, CML, TopK) the
+sketch was created as, so Sketch itself never needs to know about wrapper
+internals beyond the abstract.Counter interface.
+*/
+type Factory func() (abstract.Counter, error)
+
+/*
+Sketch is a sliding-window wrapper around any abstract.Counter: it keeps a
+ring of N sub-sketches, each covering window/N seconds, rotating the oldest
+one out (replacing it with a fresh empty bucket) as time passes. Reads are
+answered by merging every still-live bucket, so items fall out of the window
+only once their whole bucket has expired rather than individually.
+*/
+type Sketch struct {
+	mu             sync.Mutex
+	info           *abstract.Info
+	factory        Factory
+	buckets        []abstract.Counter
+	deadlines      []time.Time
+	bucketDuration time.Duration
+	cursor         int
+	// expiredAtLoad marks buckets NewSketchFromData already found past their
+	// deadline and reset, so Unmarshal knows to discard that bucket's
+	// archived bytes rather than load stale data back into a bucket whose
+	// deadline has just been pushed into the future.
+	expiredAtLoad []bool
+}
+
+/*
+NewSketch creates a windowed sketch from info.Properties["window"] (total
+window length in seconds) and info.Properties["buckets"] (ring size N),
+composing factory to build each of the N live buckets.
+*/
+func NewSketch(info *abstract.Info, factory Factory) (abstract.Counter, error) {
+	window := info.Properties["window"]
+	numBuckets := info.Properties["buckets"]
+	if window <= 0 || numBuckets <= 0 {
+		return nil, errors.New("Windowed sketch requires positive \"window\" and \"buckets\" properties")
+	}
+
+	n := int(numBuckets)
+	bucketDuration := time.Duration(window/numBuckets) * time.Second
+
+	now := time.Now()
+	buckets := make([]abstract.Counter, n)
+	deadlines := make([]time.Time, n)
+	for i := 0; i < n; i++ {
+		b, err := factory()
+		if err != nil {
+			return nil, err
+		}
+		buckets[i] = b
+		deadlines[i] = now.Add(bucketDuration * time.Duration(i+1))
+	}
+
+	s := &Sketch{
+		info:           info,
+		factory:        factory,
+		buckets:        buckets,
+		deadlines:      deadlines,
+		bucketDuration: bucketDuration,
+		cursor:         0,
+	}
+	s.persistState()
+	return s, nil
+}
+
+/*
+NewSketchFromData recreates a windowed sketch from previously persisted Info,
+discarding any bucket whose deadline has already passed so a long-stopped
+server doesn't resume with stale data counted as live.
+*/
+func NewSketchFromData(info *abstract.Info, factory Factory) (abstract.Counter, error) {
+	n := int(info.State["buckets"])
+	bucketSeconds := info.State["bucketDurationSeconds"]
+	cursor := int(info.State["cursor"])
+	if n == 0 || bucketSeconds == 0 {
+		return nil, errors.New("Invalid persisted windowed sketch state")
+	}
+
+	now := time.Now()
+	buckets := make([]abstract.Counter, n)
+	deadlines := make([]time.Time, n)
+	expired := make([]bool, n)
+	for i := 0; i < n; i++ {
+		deadlineKey := fmt.Sprintf("bucketDeadline%d", i)
+		deadline := time.Unix(int64(info.State[deadlineKey]), 0)
+
+		b, err := factory()
+		if err != nil {
+			return nil, err
+		}
+		buckets[i] = b
+		if deadline.Before(now) {
+			deadline = now.Add(time.Duration(bucketSeconds) * time.Second)
+			expired[i] = true
+		}
+		deadlines[i] = deadline
+	}
+
+	s := &Sketch{
+		info:           info,
+		factory:        factory,
+		buckets:        buckets,
+		deadlines:      deadlines,
+		bucketDuration: time.Duration(bucketSeconds) * time.Second,
+		cursor:         cursor % n,
+		expiredAtLoad:  expired,
+	}
+	return s, nil
+}
+
+// rotate replaces every bucket whose deadline has passed with a fresh empty
+// one, pushing its deadline a full bucketDuration into the future. Must be
+// called with mu held.
+func (s *Sketch) rotate() {
+	now := time.Now()
+	for i := range s.buckets {
+		if s.deadlines[i].After(now) {
+			continue
+		}
+		fresh, err := s.factory()
+		if err != nil {
+			continue
+		}
+		s.buckets[i] = fresh
+		s.deadlines[i] = now.Add(s.bucketDuration)
+		s.cursor = i
+	}
+}
+
+func (s *Sketch) current() abstract.Counter {
+	return s.buckets[s.cursor]
+}
+
+/*
+Add writes value into the current bucket.
+*/
+func (s *Sketch) Add(value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate()
+	return s.current().Add(value)
+}
+
+/*
+AddMultiple writes values into the current bucket.
+*/
+func (s *Sketch) AddMultiple(values [][]byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate()
+	return s.current().AddMultiple(values)
+}
+
+/*
+Remove is unsupported: a value could live in any live bucket and removing it
+from only the current one would be misleading.
+*/
+func (s *Sketch) Remove(value []byte) (bool, error) {
+	return false, errors.New("Remove is not supported for windowed sketches")
+}
+
+/*
+RemoveMultiple is unsupported, see Remove.
+*/
+func (s *Sketch) RemoveMultiple(values [][]byte) (bool, error) {
+	return false, errors.New("Remove is not supported for windowed sketches")
+}
+
+// merged folds every live bucket into a single throwaway sketch of the
+// underlying type, so queries see the union of the whole window.
+func (s *Sketch) merged() (abstract.Counter, error) {
+	s.rotate()
+	acc, err := s.factory()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range s.buckets {
+		if err := acc.Merge(b); err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+/*
+GetFrequency merges every live bucket and delegates to the merged sketch.
+*/
+func (s *Sketch) GetFrequency(values [][]byte) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	acc, err := s.merged()
+	if err != nil {
+		return nil
+	}
+	return acc.GetFrequency(values)
+}
+
+/*
+GetCount merges every live bucket and returns the union's count.
+*/
+func (s *Sketch) GetCount() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	acc, err := s.merged()
+	if err != nil {
+		return 0
+	}
+	return acc.GetCount()
+}
+
+/*
+GetType returns the underlying sketch's registered type.
+*/
+func (s *Sketch) GetType() string {
+	return s.info.Type
+}
+
+/*
+GetID returns the sketch's fully-qualified ID.
+*/
+func (s *Sketch) GetID() string {
+	return s.info.ID
+}
+
+/*
+Merge is unsupported: merging two independently-rotating windows would
+require reconciling mismatched bucket boundaries, which isn't meaningful in
+general.
+*/
+func (s *Sketch) Merge(other abstract.Counter) error {
+	return errors.New("Merge is not supported for windowed sketches")
+}
+
+/*
+Marshal persists each bucket's own serialized state as a length-prefixed
+chunk, back to back, alongside the bucket boundaries and last-rotation
+bookkeeping recorded in Info.State.
+*/
+func (s *Sketch) Marshal() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.persistStateLocked()
+
+	var buf bytes.Buffer
+	for _, b := range s.buckets {
+		data, err := b.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		if err := binary.Write(&buf, binary.BigEndian, uint32(len(data))); err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+Unmarshal restores each bucket's own state from the length-prefixed chunks
+produced by Marshal, in the same order the buckets were constructed in. Any
+bucket NewSketchFromData already found expired (and reset to a fresh,
+forward-dated bucket) has its archived bytes discarded rather than loaded,
+so a process that was down for a whole window doesn't resurrect stale data
+under a deadline that now claims it's live.
+*/
+func (s *Sketch) Unmarshal(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := bytes.NewReader(data)
+	for i, b := range s.buckets {
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return fmt.Errorf("Could not read windowed bucket length: %s", err)
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return fmt.Errorf("Could not read windowed bucket data: %s", err)
+		}
+		if i < len(s.expiredAtLoad) && s.expiredAtLoad[i] {
+			continue
+		}
+		if err := b.Unmarshal(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sketch) persistState() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.persistStateLocked()
+}
+
+func (s *Sketch) persistStateLocked() {
+	s.info.State["buckets"] = uint64(len(s.buckets))
+	s.info.State["bucketDurationSeconds"] = uint64(s.bucketDuration.Seconds())
+	s.info.State["cursor"] = uint64(s.cursor)
+	for i, deadline := range s.deadlines {
+		s.info.State[fmt.Sprintf("bucketDeadline%d", i)] = uint64(deadline.Unix())
+	}
+}
@@ -0,0 +1,88 @@
+package windowed
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/seiflotfy/skizze/counters/abstract"
+	"github.com/seiflotfy/skizze/counters/wrappers/bloom"
+)
+
+func bloomFactory() (abstract.Counter, error) {
+	return bloom.NewSketch(&abstract.Info{
+		Type:       abstract.Bloom,
+		Properties: map[string]float64{"capacity": 100, "errorRate": 0.01},
+		State:      make(map[string]uint64),
+	})
+}
+
+func newTestSketch(t *testing.T) *Sketch {
+	info := &abstract.Info{
+		ID:         "marvel.windowed",
+		Type:       abstract.Bloom,
+		Properties: map[string]float64{"window": 10, "buckets": 2},
+		State:      make(map[string]uint64),
+	}
+	counter, err := NewSketch(info, bloomFactory)
+	if err != nil {
+		t.Fatalf("could not create windowed sketch: %s", err)
+	}
+	return counter.(*Sketch)
+}
+
+func TestWindowedAddAndGetCount(t *testing.T) {
+	s := newTestSketch(t)
+	s.AddMultiple([][]byte{[]byte("magneto"), []byte("wasp")})
+
+	if got := s.GetCount(); got != 2 {
+		t.Fatalf("expected count 2, got %d", got)
+	}
+}
+
+func TestWindowedRotationDropsExpiredBucket(t *testing.T) {
+	s := newTestSketch(t)
+	s.Add([]byte("magneto"))
+
+	// Force the current bucket's deadline into the past without sleeping, then
+	// rotate: it should be replaced with a fresh, empty bucket.
+	s.deadlines[s.cursor] = time.Now().Add(-time.Second)
+	s.rotate()
+
+	if got := s.GetCount(); got != 0 {
+		t.Fatalf("expected rotation to drop the expired bucket's data, got count %d", got)
+	}
+}
+
+func TestWindowedUnmarshalSkipsBucketsExpiredAtLoad(t *testing.T) {
+	s := newTestSketch(t)
+	s.Add([]byte("magneto"))
+	s.Add([]byte("wasp"))
+	data, err := s.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	// Simulate a persisted deadline for bucket 0 that's already in the past,
+	// as if the process had been down for a whole bucketDuration.
+	s.info.State[fmt.Sprintf("bucketDeadline%d", 0)] = uint64(time.Now().Add(-time.Second).Unix())
+
+	restored, err := NewSketchFromData(s.info, bloomFactory)
+	if err != nil {
+		t.Fatalf("NewSketchFromData failed: %s", err)
+	}
+	r := restored.(*Sketch)
+	if !r.expiredAtLoad[0] {
+		t.Fatal("expected bucket 0 to be flagged expired at load")
+	}
+
+	if err := r.Unmarshal(data); err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	// Bucket 0's archived bytes must have been discarded rather than loaded
+	// into the freshly reset bucket NewSketchFromData already created.
+	if got := r.buckets[0].GetCount(); got != 0 {
+		t.Fatalf("expected expired bucket 0 to remain empty after Unmarshal, got count %d", got)
+	}
+}
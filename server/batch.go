@@ -0,0 +1,27 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/seiflotfy/skizze/counters"
+)
+
+/*
+handleBatch executes a JSON array of add/remove operations against the
+manager in one request, mounted at POST /batch. Each op is
+{"op": "add", "sketch": "marvel", "sketchType": "hll++", "values": [...]},
+where "sketchType" takes the same values as the <sketchType> path segment of
+the per-sketch routes; the response is a JSON array of per-op results in the
+same order.
+*/
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var ops []counters.Op
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	results := counterManager.Batch(ops)
+	writeResult(w, results)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/seiflotfy/skizze/counters"
+)
+
+func unmarshalBatchResult(t *testing.T, body []byte) []counters.Result {
+	var results []counters.Result
+	if err := json.Unmarshal(body, &results); err != nil {
+		t.Fatalf("could not unmarshal batch response: %s", err)
+	}
+	return results
+}
+
+func TestBatchReportsErrorMessages(t *testing.T) {
+	setupTests()
+	defer tearDownTests()
+	s, err := New()
+	if err != nil {
+		t.Fatalf("Expected no errors, got %s", err)
+	}
+
+	resp := httpRequest(s, t, "POST", "batch", `[
+		{"op": "add", "sketch": "marvel", "sketchType": "cardinality", "values": ["magneto"]}
+	]`)
+	if resp.Code != 200 {
+		t.Fatalf("Invalid Response Code %d - %s", resp.Code, resp.Body.String())
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	results := unmarshalBatchResult(t, body)
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if results[0].Error == "" {
+		// "marvel.cardinality" was never created, so this op is expected to
+		// fail; the point of this test is that the error is a readable
+		// string over the wire, not that this particular op succeeds.
+		t.Fatalf("expected an error for a non-existent sketch, got none")
+	}
+	if results[0].Error == "{}" {
+		t.Fatalf("expected a readable error message, got the serialized-interface placeholder %q", results[0].Error)
+	}
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"net/http"
+)
+
+/*
+handleMerge merges srcIDs into destID in place. It's reached from
+handleCreate whenever a POST <sketchType>/<dest> body carries a "merge"
+field, e.g. POST cardinality/dest {"merge": ["a", "b"]} computes the union
+cardinality of dest, a and b under dest, without re-ingesting the raw
+values.
+*/
+func (s *Server) handleMerge(w http.ResponseWriter, sketchType string, destID string, srcIDs []string) {
+	if err := counterManager.MergeSketches(destID, srcIDs, sketchType); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeResult(w, true)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/seiflotfy/skizze/counters"
+)
+
+var counterManager *counters.ManagerStruct
+
+/*
+Server dispatches the HTTP API: GET/POST/PUT/DELETE against
+<sketchType>/<id> for per-sketch operations, GET "" for the sketch listing,
+and a handful of whole-manager routes (batch ingestion, snapshot/restore).
+*/
+type Server struct {
+	mux *http.ServeMux
+}
+
+/*
+New wires up the manager singleton and every HTTP route.
+*/
+func New() (*Server, error) {
+	m, err := counters.GetManager()
+	if err != nil {
+		return nil, err
+	}
+	counterManager = m
+
+	s := &Server{mux: http.NewServeMux()}
+	s.mux.HandleFunc("/batch", s.handleBatch)
+	s.mux.HandleFunc("/snapshot", s.handleSnapshot)
+	s.mux.HandleFunc("/restore", s.handleRestore)
+	s.mux.HandleFunc("/", s.handleSketchRoute)
+	return s, nil
+}
+
+/*
+ServeHTTP lets Server be used directly as an http.Handler, e.g. behind
+httptest or http.ListenAndServe.
+*/
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleSketchRoute(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "" {
+		s.handleList(w, r)
+		return
+	}
+
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 {
+		writeError(w, errors.New("Expected <sketchType>/<id>"))
+		return
+	}
+	sketchType, id := parts[0], parts[1]
+
+	switch r.Method {
+	case "GET":
+		s.handleGet(w, r, sketchType, id)
+	case "POST":
+		s.handleCreate(w, r, sketchType, id)
+	case "PUT":
+		s.handleAdd(w, r, sketchType, id)
+	case "DELETE":
+		s.handleDelete(w, r, sketchType, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	sketches, err := counterManager.GetSketches()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, sketches)
+}
+
+/*
+handleCreate handles POST <sketchType>/<id>. A body containing a "merge"
+array is a request to merge those source sketches into id rather than create
+a new one; anything else is treated as sketch creation, with every numeric
+field in the body becoming a manager property (capacity, errorRate, window,
+buckets, ...).
+*/
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request, sketchType string, id string) {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if raw, ok := body["merge"]; ok {
+		srcIDs, ok := toStringSlice(raw)
+		if !ok {
+			writeError(w, errors.New("\"merge\" must be an array of sketch IDs"))
+			return
+		}
+		s.handleMerge(w, sketchType, id, srcIDs)
+		return
+	}
+
+	props := make(map[string]float64)
+	for k, v := range body {
+		if f, ok := v.(float64); ok {
+			props[k] = f
+		}
+	}
+	if err := counterManager.CreateSketch(id, sketchType, props); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, true)
+}
+
+func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request, sketchType string, id string) {
+	var body struct {
+		Values []string `json:"values"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := counterManager.AddToSketch(id, sketchType, body.Values); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, true)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request, sketchType string, id string) {
+	var body struct {
+		Values []string `json:"values"`
+	}
+	// A body is optional for a plain cardinality query.
+	json.NewDecoder(r.Body).Decode(&body)
+
+	result, err := counterManager.GetCountForSketch(id, sketchType, body.Values)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, result)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, sketchType string, id string) {
+	if err := counterManager.DeleteSketch(id, sketchType); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, true)
+}
+
+func toStringSlice(v interface{}) ([]string, bool) {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	out := make([]string, len(arr))
+	for i, e := range arr {
+		str, ok := e.(string)
+		if !ok {
+			return nil, false
+		}
+		out[i] = str
+	}
+	return out, true
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": result, "error": nil})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"result": nil, "error": err.Error()})
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+)
+
+/*
+handleSnapshot streams a full backup of every sketch to the client, mounted
+at GET /snapshot. The response is written directly as it's produced, so the
+client receives it as a chunked download rather than waiting for the whole
+archive to be buffered.
+*/
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := counterManager.Snapshot(w); err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+/*
+handleRestore rebuilds the in-memory sketch table from an archive previously
+produced by handleSnapshot, mounted at POST /restore. This lets an operator
+stand up a warm replica by periodically shipping snapshots to it.
+*/
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if err := counterManager.Restore(r.Body); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResult(w, true)
+}